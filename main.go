@@ -2,14 +2,26 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/irc.v3"
 )
@@ -20,10 +32,32 @@ var (
 	messageCounter uint32
 	cfg            Config
 	life           state
+	store          SubStore
+	overlayEvents  = &eventBroadcaster{}
+
+	// lifeMu guards all reads and writes of life, since it's now reachable
+	// from the IRC message loop and the HTTP API concurrently.
+	lifeMu sync.Mutex
+
+	// pendingSaslPayload holds the base64 PLAIN response we owe the server
+	// once it prompts us with "AUTHENTICATE +". Reset per-connection.
+	pendingSaslPayload string
+
+	// activeConn is the raw connection behind the current irc.Client, kept
+	// around so a failed handshake write can close it (see abortHandshake)
+	// without plumbing an error return through the Handler interface.
+	// Reset per-connection.
+	activeConn net.Conn
 )
 
 const (
 	overwriteSubCountCommand = "!nonprimesubcount "
+	overwriteT2CountCommand  = "!nonprimet2count "
+	overwriteT3CountCommand  = "!nonprimet3count "
+	resetCommand             = "!nonprimereset"
+
+	initialReconnectBackoff = time.Second
+	maxReconnectBackoff     = 2 * time.Minute
 )
 
 type Config struct {
@@ -34,16 +68,76 @@ type Config struct {
 	IRCUser    string `json:"irc_user"`
 	IRCChannel string `json:"irc_channel"`
 
-	// if this file exists, we read the initial non-prime subcount from it.
-	// then, we keep it updated with the latest non-prime subcount.
-	// use "!nonprimesubcount 0" in chat to reset it.
-	OutputFile string `json:"output_file"`
+	// dial the IRC address over TLS instead of cleartext. Twitch's chat
+	// server requires this on its standard ports.
+	TLS bool `json:"tls,omitempty"`
+
+	// perform SASL PLAIN authentication using IRCUser/OAuthToken instead of
+	// Twitch's "PASS oauth:xxx" alternative; no PASS is sent when this is
+	// set. JOIN is withheld until the server confirms SASL succeeded.
+	SASL bool `json:"sasl,omitempty"`
+
+	// Twitch OAuth token (without the "oauth:" prefix) used either as the
+	// SASL PLAIN password or, if SASL is false, sent as the connection PASS.
+	OAuthToken string `json:"oauth_token,omitempty"`
+
+	// StorageDriver selects the SubStore backend: "file" (the default) for
+	// one file per counter under OutputDir, or "sqlite" for a queryable
+	// history of every sub event.
+	StorageDriver string `json:"storage_driver,omitempty"`
+
+	// StorageDSN is the SQLite DSN (typically a file path) used by the
+	// "sqlite" driver. The "file" driver uses OutputDir instead.
+	StorageDSN string `json:"storage_dsn,omitempty"`
+
+	// OutputDir is where the "file" driver atomically writes one file per
+	// counter (t1.txt, t2.txt, ..., current_month_total.txt) plus a
+	// combined state.json, so a reader (e.g. OBS) never sees a half-written
+	// value.
+	OutputDir string `json:"output_dir"`
+
+	// if set, serve GET /subcount, GET /events (SSE) and POST /subcount on
+	// this address, so an OBS browser source can show the count without
+	// polling a file.
+	HTTPListen string `json:"http_listen,omitempty"`
+
+	// required "Authorization: Bearer <token>" value for POST /subcount.
+	// POST is refused entirely if this is empty.
+	HTTPAuthToken string `json:"http_auth_token,omitempty"`
+
+	// count subgift/anonsubgift towards the subcount (one per gifted sub).
+	// submysterygift never counts, since each recipient's own subgift notice
+	// already does. Off by default since these are usually celebrated
+	// separately from the non-prime count.
+	CountGiftSubs bool `json:"count_gift_subs,omitempty"`
+
+	// count giftpaidupgrade/anongiftpaidupgrade (continuing a gifted sub on
+	// your own dime) towards the subcount. primepaidupgrade always counts,
+	// regardless of this setting, since it's unambiguously a new non-prime sub.
+	CountGiftUpgrades bool `json:"count_gift_upgrades,omitempty"`
+
+	// for resub, count msg-param-multimonth-duration months instead of a
+	// flat 1, so a prepaid multi-month resub isn't undercounted.
+	CountResubMonths bool `json:"count_resub_months,omitempty"`
 }
 
 func main() {
-	newMessage = make(chan *irc.Message, 16)
 	logger = logrus.New()
 
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+
+	runBot()
+}
+
+// runBot is the normal entrypoint: connect to IRC and keep the subcount
+// updated forever. `replay` bypasses this entirely in favor of a pure,
+// network-free simulation.
+func runBot() {
+	newMessage = make(chan *irc.Message, 16)
+
 	cfgPath := os.Getenv("EZNOPRIMES_CONFIG_PATH")
 	if cfgPath == "" {
 		cfgPath = "config.json"
@@ -64,64 +158,208 @@ func main() {
 		logger.SetLevel(logrus.DebugLevel)
 	}
 
+	subStore, err := newSubStore(cfg)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to initialize storage backend")
+	}
+	store = subStore
+
+	loadState()
+	go handleMessages()
+	go printAfterFirstMessage()
+	go printMessageVelocityEvery15Mins()
+	startHTTPServer(cfg.HTTPListen)
+
+	runForever()
+}
+
+// runForever dials and runs the IRC client, transparently reconnecting with
+// exponential backoff and jitter on disconnect. The global `life` state is
+// untouched across reconnects, so subcount survives a dropped connection.
+func runForever() {
+	backoff := initialReconnectBackoff
+	for {
+		if err := connectAndRun(); err != nil {
+			logger.WithError(err).Warn("failed to connect to IRC")
+		} else {
+			logger.Warn("IRC connection closed")
+		}
+
+		sleep := backoff + jitter(backoff)
+		logger.WithField("retry-in", sleep).Info("reconnecting to IRC")
+		time.Sleep(sleep)
+
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// nextBackoff doubles backoff, capping it at maxReconnectBackoff. Shared by
+// runForever and reliableDial so the two backoff loops can't drift apart.
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxReconnectBackoff {
+		backoff = maxReconnectBackoff
+	}
+	return backoff
+}
+
+var debugReplayOnce sync.Once
+
+func connectAndRun() error {
 	logger.WithField("address", cfg.IRCAddress).Info("connecting")
-	conn, err := reliableDial("tcp", cfg.IRCAddress, 5)
+	conn, err := reliableDial("tcp", cfg.IRCAddress, cfg.TLS)
 	if err != nil {
-		logger.WithError(err).Fatal("failed to dial IRC address multiple times, aborting")
+		return err
 	}
 
+	resetConnState(conn)
+
 	config := irc.ClientConfig{
 		Nick:    cfg.IRCUser,
 		User:    cfg.IRCUser,
 		Name:    cfg.IRCUser,
 		Handler: irc.HandlerFunc(ircHandler),
 	}
-
-	loadState()
-	go handleMessages()
-	go printAfterFirstMessage()
-	go printMessageVelocityEvery15Mins()
+	if !cfg.SASL && cfg.OAuthToken != "" {
+		// Twitch's simpler alternative to SASL: send the token as our PASS.
+		config.Pass = "oauth:" + cfg.OAuthToken
+	}
 
 	client := irc.NewClient(conn, config)
-	go importDebugInputFile(client)
-	if err := client.Run(); err != nil {
-		logger.WithError(err).Fatal("failure during IRC run")
+	debugReplayOnce.Do(func() {
+		go importDebugInputFile(client)
+	})
+	return client.Run()
+}
+
+// jitter returns a random duration in [0, d], so that many reconnecting
+// clients don't all hammer the server in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func resetConnState(conn net.Conn) {
+	pendingSaslPayload = ""
+	activeConn = conn
+}
+
+// abortHandshake logs a non-fatal warning and closes the connection, so the
+// CAP/SASL/JOIN handshake can't os.Exit the whole process on a single
+// transient write error. Closing forces client.Run() to return, which
+// connectAndRun already surfaces to runForever's reconnect-with-backoff loop.
+func abortHandshake(err error, msg string) {
+	logger.WithError(err).Warn(msg)
+	if activeConn != nil {
+		activeConn.Close()
 	}
 }
 
-func reliableDial(network, address string, maxAttempts int) (conn net.Conn, err error) {
-	attempts := 0
+// reliableDial keeps dialing with exponential backoff and jitter until it
+// succeeds; it never gives up, so it never returns a dial error to
+// runForever.
+func reliableDial(network, address string, useTLS bool) (conn net.Conn, err error) {
+	backoff := initialReconnectBackoff
 	for {
-		conn, err = net.Dial(network, address)
-		if err == nil {
-			return
+		if useTLS {
+			conn, err = tls.Dial(network, address, &tls.Config{})
+		} else {
+			conn, err = net.Dial(network, address)
 		}
-		attempts++
-		if attempts >= maxAttempts {
+		if err == nil {
 			return
 		}
-		time.Sleep(time.Second)
+
+		sleep := backoff + jitter(backoff)
+		logger.WithError(err).WithField("retry-in", sleep).Warn("failed to dial IRC address, retrying")
+		time.Sleep(sleep)
+
+		backoff = nextBackoff(backoff)
 	}
 }
 
 func ircHandler(c *irc.Client, m *irc.Message) {
 	logger.WithField("message", m.String()).Debug("received message")
-	if m.Command == "001" {
+	switch m.Command {
+	case "001":
 		// 001 is a welcome event, so start our setup process
-		if err := c.Write("CAP REQ :twitch.tv/tags twitch.tv/commands"); err != nil {
-			logger.WithError(err).Fatal("failed to request caps")
+		logger.WithField("channel", cfg.IRCChannel).Info("knock knock")
+		requestCaps(c)
+		if !cfg.SASL {
+			// no SASL requested, so there's nothing to wait on
+			joinChannel(c)
 		}
-		if err := c.Write("JOIN #" + cfg.IRCChannel); err != nil {
-			logger.WithError(err).Fatal("failed to join channel")
+	case "CAP":
+		handleCap(c, m)
+	case "AUTHENTICATE":
+		handleAuthenticate(c, m)
+	case "903":
+		logger.Info("SASL authentication succeeded")
+		endCapNegotiation(c)
+		joinChannel(c)
+	case "904", "905":
+		logger.WithField("message", m.String()).Fatal("SASL authentication failed")
+	case "ROOMSTATE":
+		if m.Trailing() == "#"+cfg.IRCChannel {
+			// emitted when a room join is successful
+			logger.WithField("channel", cfg.IRCChannel).Info("party time")
 		}
-		logger.WithField("channel", cfg.IRCChannel).Info("knock knock")
-	} else if m.Command == "ROOMSTATE" && m.Trailing() == "#"+cfg.IRCChannel {
-		// emitted when a room join is successful
-		logger.WithField("channel", cfg.IRCChannel).Info("party time")
-	} else if (m.Command == "PRIVMSG" || m.Command == "USERNOTICE") && c.FromChannel(m) {
-		// regular chat message or event
-		newMessage <- m
-		atomic.AddUint32(&messageCounter, 1)
+	case "PRIVMSG", "USERNOTICE":
+		if c.FromChannel(m) {
+			// regular chat message or event
+			newMessage <- m
+			atomic.AddUint32(&messageCounter, 1)
+		}
+	}
+}
+
+func requestCaps(c *irc.Client) {
+	caps := "twitch.tv/tags twitch.tv/commands"
+	if cfg.SASL {
+		caps += " sasl"
+	}
+	if err := c.Write("CAP REQ :" + caps); err != nil {
+		abortHandshake(err, "failed to request caps")
+	}
+}
+
+func handleCap(c *irc.Client, m *irc.Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	switch m.Params[1] {
+	case "ACK":
+		if cfg.SASL && strings.Contains(m.Trailing(), "sasl") {
+			pendingSaslPayload = base64.StdEncoding.EncodeToString(
+				[]byte("\x00" + cfg.IRCUser + "\x00" + cfg.OAuthToken),
+			)
+			if err := c.Write("AUTHENTICATE PLAIN"); err != nil {
+				abortHandshake(err, "failed to start SASL authentication")
+			}
+		}
+	case "NAK":
+		logger.WithField("caps", m.Trailing()).Warn("server rejected requested capabilities")
+	}
+}
+
+func handleAuthenticate(c *irc.Client, m *irc.Message) {
+	if m.Trailing() != "+" || pendingSaslPayload == "" {
+		return
+	}
+	if err := c.Write("AUTHENTICATE " + pendingSaslPayload); err != nil {
+		abortHandshake(err, "failed to send SASL credentials")
+	}
+}
+
+func endCapNegotiation(c *irc.Client) {
+	if err := c.Write("CAP END"); err != nil {
+		abortHandshake(err, "failed to end capability negotiation")
+	}
+}
+
+func joinChannel(c *irc.Client) {
+	if err := c.Write("JOIN #" + cfg.IRCChannel); err != nil {
+		abortHandshake(err, "failed to join channel")
 	}
 }
 
@@ -153,6 +391,131 @@ func importDebugInputFile(c *irc.Client) {
 	logger.Info("finished replaying debug input")
 }
 
+// transcriptEntry is one row of a replay transcript: the input line and
+// what our pure state machine decided to do with it.
+type transcriptEntry struct {
+	Line   string `json:"line"`
+	Action action `json:"action"`
+	Subs   int    `json:"subs"`
+}
+
+// runReplay implements `eznoprimes replay --input log.txt --expect
+// golden.json`: it feeds a captured IRC log through messageOutcome +
+// state.MergeOutcome without touching the network, prints the resulting
+// transcript as JSON, and, if --expect is given, diffs it against a golden
+// transcript so new msg-id/sub-plan handling can be regression-tested
+// against real captured chat dumps.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	input := fs.String("input", "", "path to a captured IRC log, one message per line")
+	expect := fs.String("expect", "", "optional golden transcript (JSON) to diff the replay against")
+	fs.Parse(args)
+
+	if *input == "" {
+		logger.Fatal("replay requires --input")
+	}
+
+	transcript, err := replayLog(*input)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to replay input")
+	}
+
+	out, err := json.MarshalIndent(transcript, "", "  ")
+	if err != nil {
+		logger.WithError(err).Fatal("failed to marshal replay transcript")
+	}
+	fmt.Println(string(out))
+
+	if *expect == "" {
+		return
+	}
+
+	goldenBytes, err := os.ReadFile(*expect)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to read golden file")
+	}
+
+	var golden []transcriptEntry
+	if err := json.Unmarshal(goldenBytes, &golden); err != nil {
+		logger.WithError(err).Fatal("failed to parse golden file")
+	}
+
+	if diff := diffTranscript(golden, transcript); diff != "" {
+		logger.Fatal("replay does not match golden output:\n" + diff)
+	}
+
+	logger.Info("replay matches golden output")
+}
+
+// replayLog parses a captured IRC log and runs it through the same pure
+// messageOutcome/state.MergeOutcome pair the live bot uses, against a
+// throwaway state rather than the global `life`. It never calls
+// performAction, so nothing touches disk or the network.
+func replayLog(path string) ([]transcriptEntry, error) {
+	handle, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	var replayState state
+	var transcript []transcriptEntry
+
+	scanner := bufio.NewScanner(handle)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		m, err := irc.ParseMessage(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message %q: %w", line, err)
+		}
+
+		o := messageOutcome(m)
+		a := replayState.MergeOutcome(o)
+
+		transcript = append(transcript, transcriptEntry{
+			Line:   line,
+			Action: a,
+			Subs:   replayState.Total(),
+		})
+	}
+
+	return transcript, scanner.Err()
+}
+
+// diffTranscript renders a human-readable diff between a golden transcript
+// and a freshly replayed one.
+func diffTranscript(want, got []transcriptEntry) string {
+	var sb strings.Builder
+
+	max := len(want)
+	if len(got) > max {
+		max = len(got)
+	}
+
+	for i := 0; i < max; i++ {
+		var w, g transcriptEntry
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+		if !reflect.DeepEqual(w, g) {
+			fmt.Fprintf(&sb, "entry %d:\n  want: %+v\n  got:  %+v\n", i, w, g)
+		}
+	}
+
+	if len(want) != len(got) {
+		fmt.Fprintf(&sb, "entry count: want %d, got %d\n", len(want), len(got))
+	}
+
+	return sb.String()
+}
+
 // print something after we receive our first message, so we know stuff kinda works
 func printAfterFirstMessage() {
 	ticker := time.NewTicker(time.Second)
@@ -184,23 +547,84 @@ func printMessageVelocityEvery15Mins() {
 
 // messages can add or overwrite the sub count
 type outcome struct {
-	incrementSubs bool
-	overwriteSubs bool
-	subs          int
+	// delta holds amounts to add to the matching state counters.
+	delta state
+
+	// overwriteTier, if non-zero (1, 2, or 3), replaces that tier's counter
+	// with overwriteValue. Used by !nonprimesubcount/!nonprimet2count/!nonprimet3count.
+	overwriteTier  int
+	overwriteValue int
+
+	// resetAll zeroes every counter. Used by !nonprimereset.
+	resetAll bool
+
+	// reason records which msg-id produced this outcome (with a ":prime"
+	// suffix for a Prime sub/resub), purely for observability - it has no
+	// effect on behavior. The tier is not recorded in it.
+	reason string
+}
+
+// counted reports whether this outcome added to any counter.
+func (o outcome) counted() bool {
+	return o.delta != (state{})
 }
 
 func messageOutcome(m *irc.Message) outcome {
 	var outcome outcome
 
 	if m.Command == "USERNOTICE" {
-		// this should be a non-prime sub or resub message
 		msgID, _ := m.Tags.GetTag("msg-id")
-		if msgID == "sub" || msgID == "resub" {
-			msgSubPlan, _ := m.Tags.GetTag("msg-param-sub-plan")
-			if msgSubPlan != "Prime" {
-				outcome.incrementSubs = true
-				outcome.subs = 1
+		msgSubPlan, _ := m.Tags.GetTag("msg-param-sub-plan")
+		prime := msgSubPlan == "Prime"
+		tier := planTier(msgSubPlan)
+
+		switch msgID {
+		case "sub", "resub":
+			if prime {
+				outcome.reason = msgID + ":prime"
+				break
+			}
+			months := resubMonths(m, msgID)
+			outcome.delta = tierDelta(tier, months)
+			outcome.delta.currentMonthTotal = months
+			outcome.reason = msgID
+
+		case "subgift", "anonsubgift":
+			outcome.reason = msgID
+			if cfg.CountGiftSubs {
+				outcome.delta = giftTierDelta(tier, 1)
+				outcome.delta.currentMonthTotal = 1
+			}
+
+		case "submysterygift":
+			// observability only: this is the mass-gift summary notice. The
+			// individual subgift notice for each recipient is what actually
+			// counts, so counting this too would double (over-)count every
+			// mass gift by one.
+			outcome.reason = msgID
+
+		case "primepaidupgrade":
+			// the user just converted off Prime onto a paid tier, so this
+			// is unambiguously a new non-prime sub, regardless of policy.
+			// It's tallied both against its tier and as a prime conversion.
+			outcome.delta = tierDelta(tier, 1)
+			outcome.delta.primeConversions = 1
+			outcome.delta.currentMonthTotal = 1
+			outcome.reason = msgID
+
+		case "giftpaidupgrade", "anongiftpaidupgrade":
+			outcome.reason = msgID
+			if cfg.CountGiftUpgrades {
+				// the user is now paying for it themselves, so it counts
+				// as a regular tier sub rather than a gift.
+				outcome.delta = tierDelta(tier, 1)
+				outcome.delta.currentMonthTotal = 1
 			}
+
+		case "standardpayforward", "communitypayforward":
+			// observability only: the recipient's own subgift/upgrade
+			// notice is what counts, this is just the "paid it forward" flair
+			outcome.reason = msgID
 		}
 	}
 
@@ -212,13 +636,23 @@ func messageOutcome(m *irc.Message) outcome {
 			badges, _ := m.Tags.GetTag("badges")
 			broadcaster := strings.Contains(badges, "broadcaster/1") // idk how to check otherwise
 			if mod == "1" || broadcaster {
-				if strings.HasPrefix(trailing, overwriteSubCountCommand) {
-					amt, err := strconv.Atoi(trailing[len(overwriteSubCountCommand):])
-					if err != nil {
-						logger.WithError(err).WithField("trailing", trailing).Warn("failed to parse amounts from overwrite command")
-					} else {
-						outcome.overwriteSubs = true
-						outcome.subs = amt
+				switch {
+				case trailing == resetCommand:
+					outcome.resetAll = true
+				case strings.HasPrefix(trailing, overwriteT2CountCommand):
+					if amt, ok := parseCommandAmount(trailing, overwriteT2CountCommand); ok {
+						outcome.overwriteTier = 2
+						outcome.overwriteValue = amt
+					}
+				case strings.HasPrefix(trailing, overwriteT3CountCommand):
+					if amt, ok := parseCommandAmount(trailing, overwriteT3CountCommand); ok {
+						outcome.overwriteTier = 3
+						outcome.overwriteValue = amt
+					}
+				case strings.HasPrefix(trailing, overwriteSubCountCommand):
+					if amt, ok := parseCommandAmount(trailing, overwriteSubCountCommand); ok {
+						outcome.overwriteTier = 1
+						outcome.overwriteValue = amt
 					}
 				}
 			}
@@ -228,47 +662,235 @@ func messageOutcome(m *irc.Message) outcome {
 	return outcome
 }
 
-// our program tracks the subcount
+// parseCommandAmount parses the integer argument following a command
+// prefix, logging and reporting failure rather than erroring.
+func parseCommandAmount(trailing, prefix string) (int, bool) {
+	amt, err := strconv.Atoi(strings.TrimSpace(trailing[len(prefix):]))
+	if err != nil {
+		logger.WithError(err).WithField("trailing", trailing).Warn("failed to parse amount from command")
+		return 0, false
+	}
+	return amt, true
+}
+
+// resubMonths returns how many months a resub should count for: a flat 1,
+// unless CountResubMonths is enabled and the notice carries a prepaid
+// multi-month duration.
+func resubMonths(m *irc.Message, msgID string) int {
+	if msgID != "resub" || !cfg.CountResubMonths {
+		return 1
+	}
+
+	months, err := strconv.Atoi(firstTag(m, "msg-param-multimonth-duration"))
+	if err != nil || months < 1 {
+		return 1
+	}
+	return months
+}
+
+// planTier maps a msg-param-sub-plan value to 1, 2, or 3. Prime is handled
+// separately by callers; anything else unrecognized defaults to tier 1.
+func planTier(plan string) int {
+	switch plan {
+	case "2000":
+		return 2
+	case "3000":
+		return 3
+	default:
+		return 1
+	}
+}
+
+// tierDelta returns a state delta incrementing t1/t2/t3 by amount.
+func tierDelta(tier, amount int) state {
+	switch tier {
+	case 2:
+		return state{t2: amount}
+	case 3:
+		return state{t3: amount}
+	default:
+		return state{t1: amount}
+	}
+}
+
+// giftTierDelta returns a state delta incrementing giftT1/giftT2/giftT3 by amount.
+func giftTierDelta(tier, amount int) state {
+	switch tier {
+	case 2:
+		return state{giftT2: amount}
+	case 3:
+		return state{giftT3: amount}
+	default:
+		return state{giftT1: amount}
+	}
+}
+
+// state tracks per-tier and per-streak sub counters, kept entirely
+// in-memory and mirrored to disk by performAction.
 type state struct {
-	subs int
+	t1 int
+	t2 int
+	t3 int
+
+	giftT1 int
+	giftT2 int
+	giftT3 int
+
+	primeConversions int
+
+	// currentMonthTotal is every counted sub since the last !nonprimereset.
+	currentMonthTotal int
+}
+
+// Total is the running non-prime subcount across every tier and gift
+// counter. primeConversions isn't added again here: a prime conversion is
+// already reflected in its tier's counter.
+func (s state) Total() int {
+	return s.t1 + s.t2 + s.t3 + s.giftT1 + s.giftT2 + s.giftT3
 }
 
-// when it is updated, write the new value to disk
+// action flags which counters changed, so performAction only rewrites what
+// actually needs rewriting.
 type action struct {
-	writeSubs bool
+	DirtyT1                bool `json:"dirty_t1,omitempty"`
+	DirtyT2                bool `json:"dirty_t2,omitempty"`
+	DirtyT3                bool `json:"dirty_t3,omitempty"`
+	DirtyGiftT1            bool `json:"dirty_gift_t1,omitempty"`
+	DirtyGiftT2            bool `json:"dirty_gift_t2,omitempty"`
+	DirtyGiftT3            bool `json:"dirty_gift_t3,omitempty"`
+	DirtyPrimeConversions  bool `json:"dirty_prime_conversions,omitempty"`
+	DirtyCurrentMonthTotal bool `json:"dirty_current_month_total,omitempty"`
+}
+
+// any reports whether any counter changed, i.e. whether a write is needed at all.
+func (a action) any() bool {
+	return a.DirtyT1 || a.DirtyT2 || a.DirtyT3 ||
+		a.DirtyGiftT1 || a.DirtyGiftT2 || a.DirtyGiftT3 ||
+		a.DirtyPrimeConversions || a.DirtyCurrentMonthTotal
 }
 
 func (s *state) MergeOutcome(o outcome) action {
-	var action action
+	if o.resetAll {
+		*s = state{}
+		return action{
+			DirtyT1: true, DirtyT2: true, DirtyT3: true,
+			DirtyGiftT1: true, DirtyGiftT2: true, DirtyGiftT3: true,
+			DirtyPrimeConversions: true, DirtyCurrentMonthTotal: true,
+		}
+	}
+
+	var a action
 
-	if o.incrementSubs {
-		s.subs += o.subs
-		action.writeSubs = true
+	if o.delta.t1 != 0 {
+		s.t1 += o.delta.t1
+		a.DirtyT1 = true
+	}
+	if o.delta.t2 != 0 {
+		s.t2 += o.delta.t2
+		a.DirtyT2 = true
+	}
+	if o.delta.t3 != 0 {
+		s.t3 += o.delta.t3
+		a.DirtyT3 = true
+	}
+	if o.delta.giftT1 != 0 {
+		s.giftT1 += o.delta.giftT1
+		a.DirtyGiftT1 = true
+	}
+	if o.delta.giftT2 != 0 {
+		s.giftT2 += o.delta.giftT2
+		a.DirtyGiftT2 = true
+	}
+	if o.delta.giftT3 != 0 {
+		s.giftT3 += o.delta.giftT3
+		a.DirtyGiftT3 = true
+	}
+	if o.delta.primeConversions != 0 {
+		s.primeConversions += o.delta.primeConversions
+		a.DirtyPrimeConversions = true
+	}
+	if o.delta.currentMonthTotal != 0 {
+		s.currentMonthTotal += o.delta.currentMonthTotal
+		a.DirtyCurrentMonthTotal = true
 	}
 
-	if o.overwriteSubs {
-		s.subs = o.subs
-		action.writeSubs = true
+	if o.overwriteTier != 0 {
+		switch o.overwriteTier {
+		case 1:
+			s.t1 = o.overwriteValue
+			a.DirtyT1 = true
+		case 2:
+			s.t2 = o.overwriteValue
+			a.DirtyT2 = true
+		case 3:
+			s.t3 = o.overwriteValue
+			a.DirtyT3 = true
+		}
 	}
 
-	return action
+	return a
 }
 
+// performAction must be called with lifeMu held, since it reads life.
 func performAction(action action) {
-	if action.writeSubs {
-		err := os.WriteFile(cfg.OutputFile, []byte(strconv.Itoa(life.subs)), os.ModePerm)
-		if err != nil {
-			logger.WithError(err).Warn("failed to write subcount to output file")
-		} else {
-			logger.WithField("subs", life.subs).Info("wrote subcount")
-		}
+	if !action.any() {
+		return
+	}
+
+	if err := store.Snapshot(life, action); err != nil {
+		logger.WithError(err).Warn("failed to persist state")
+	} else {
+		logger.WithField("state", life).Info("wrote state")
 	}
+
+	overlayEvents.Publish(overlayEvent{Subs: life.Total(), Time: time.Now()})
 }
 
 func handleMessage(m *irc.Message) {
 	outcome := messageOutcome(m)
+
+	lifeMu.Lock()
 	action := life.MergeOutcome(outcome)
 	performAction(action)
+	lifeMu.Unlock()
+
+	if m.Command == "USERNOTICE" {
+		recordSubEvent(m, outcome)
+	}
+}
+
+// recordSubEvent appends an audit row for every USERNOTICE we see,
+// regardless of whether it counted, so operators can later answer
+// "why is the count 47?" or regenerate history.
+func recordSubEvent(m *irc.Message, o outcome) {
+	msgID, _ := m.Tags.GetTag("msg-id")
+	subPlan, _ := m.Tags.GetTag("msg-param-sub-plan")
+	login, _ := m.Tags.GetTag("login")
+	months, _ := strconv.Atoi(firstTag(m, "msg-param-cumulative-months", "msg-param-months"))
+
+	evt := SubEvent{
+		Time:    time.Now(),
+		User:    login,
+		MsgID:   msgID,
+		SubPlan: subPlan,
+		Months:  months,
+		Counted: o.counted(),
+		Reason:  o.reason,
+	}
+
+	if err := store.AppendEvent(evt); err != nil {
+		logger.WithError(err).Warn("failed to append sub event")
+	}
+}
+
+// firstTag returns the first non-empty tag value among keys, or "" if none are set.
+func firstTag(m *irc.Message, keys ...string) string {
+	for _, key := range keys {
+		if v, ok := m.Tags.GetTag(key); ok && v != "" {
+			return v
+		}
+	}
+	return ""
 }
 
 func handleMessages() {
@@ -278,25 +900,515 @@ func handleMessages() {
 }
 
 func loadState() {
-	contents, err := os.ReadFile(cfg.OutputFile)
-	if os.IsNotExist(err) {
-		os.WriteFile(cfg.OutputFile, []byte("0"), os.ModePerm)
-		logger.Info("previous subcount not found, starting at 0, saved new file")
+	s, err := store.Load()
+	if err != nil {
+		logger.WithError(err).Warn("failed to load previous state, ignoring, starting at 0")
 		return
+	}
+
+	lifeMu.Lock()
+	life = s
+	lifeMu.Unlock()
+
+	logger.WithField("state", s).Info("loaded previous state")
+}
+
+// SubStore persists the running subcount and an audit trail of every sub
+// event that contributed to it.
+type SubStore interface {
+	// Load returns the last persisted state, or a zero state if none exists yet.
+	Load() (state, error)
+	// AppendEvent records a single USERNOTICE outcome for later auditing.
+	AppendEvent(evt SubEvent) error
+	// Snapshot persists the current running state. dirty marks which
+	// counters actually changed, so a backend that writes one file per
+	// counter can skip the ones that didn't.
+	Snapshot(s state, dirty action) error
+}
+
+// SubEvent is a single USERNOTICE outcome, recorded whether or not it
+// counted towards the subcount.
+type SubEvent struct {
+	Time    time.Time
+	User    string
+	MsgID   string
+	SubPlan string
+	Months  int
+	Counted bool
+
+	// Reason is outcome.reason: the msg-id (with a ":prime" suffix for a
+	// Prime sub/resub) that produced this event, for operators auditing why
+	// something did or didn't count.
+	Reason string
+}
+
+func newSubStore(cfg Config) (SubStore, error) {
+	switch cfg.StorageDriver {
+	case "", "file":
+		return newFileSubStore(cfg.OutputDir), nil
+	case "sqlite":
+		return newSQLiteSubStore(cfg.StorageDSN)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
+	}
+}
+
+// counterFile maps one on-disk counter file to the state field it mirrors
+// and the action flag that marks that field dirty.
+type counterFile struct {
+	field func(*state) *int
+	dirty func(action) bool
+}
+
+// stateCounterFiles maps each on-disk counter file, under OutputDir, to the
+// state field it mirrors, so fileSubStore.Snapshot only rewrites the files
+// whose counter actually changed.
+var stateCounterFiles = map[string]counterFile{
+	"t1.txt":                  {field: func(s *state) *int { return &s.t1 }, dirty: func(a action) bool { return a.DirtyT1 }},
+	"t2.txt":                  {field: func(s *state) *int { return &s.t2 }, dirty: func(a action) bool { return a.DirtyT2 }},
+	"t3.txt":                  {field: func(s *state) *int { return &s.t3 }, dirty: func(a action) bool { return a.DirtyT3 }},
+	"gift_t1.txt":             {field: func(s *state) *int { return &s.giftT1 }, dirty: func(a action) bool { return a.DirtyGiftT1 }},
+	"gift_t2.txt":             {field: func(s *state) *int { return &s.giftT2 }, dirty: func(a action) bool { return a.DirtyGiftT2 }},
+	"gift_t3.txt":             {field: func(s *state) *int { return &s.giftT3 }, dirty: func(a action) bool { return a.DirtyGiftT3 }},
+	"prime_conversions.txt":   {field: func(s *state) *int { return &s.primeConversions }, dirty: func(a action) bool { return a.DirtyPrimeConversions }},
+	"current_month_total.txt": {field: func(s *state) *int { return &s.currentMonthTotal }, dirty: func(a action) bool { return a.DirtyCurrentMonthTotal }},
+}
+
+const stateFileName = "state.json"
+
+// stateJSON is the JSON-friendly mirror of state, since state's fields are
+// unexported.
+type stateJSON struct {
+	T1                int `json:"t1"`
+	T2                int `json:"t2"`
+	T3                int `json:"t3"`
+	GiftT1            int `json:"gift_t1"`
+	GiftT2            int `json:"gift_t2"`
+	GiftT3            int `json:"gift_t3"`
+	PrimeConversions  int `json:"prime_conversions"`
+	CurrentMonthTotal int `json:"current_month_total"`
+}
+
+func (s state) toJSON() stateJSON {
+	return stateJSON{
+		T1: s.t1, T2: s.t2, T3: s.t3,
+		GiftT1: s.giftT1, GiftT2: s.giftT2, GiftT3: s.giftT3,
+		PrimeConversions:  s.primeConversions,
+		CurrentMonthTotal: s.currentMonthTotal,
+	}
+}
+
+func (j stateJSON) toState() state {
+	return state{
+		t1: j.T1, t2: j.T2, t3: j.T3,
+		giftT1: j.GiftT1, giftT2: j.GiftT2, giftT3: j.GiftT3,
+		primeConversions:  j.PrimeConversions,
+		currentMonthTotal: j.CurrentMonthTotal,
+	}
+}
+
+// fileSubStore writes one file per counter under dir (t1.txt, t2.txt, ...)
+// plus a combined state.json, each via a tempfile + rename so a reader
+// (e.g. OBS) never sees a half-written value. It has no event history.
+type fileSubStore struct {
+	dir string
+}
+
+func newFileSubStore(dir string) *fileSubStore {
+	return &fileSubStore{dir: dir}
+}
+
+func (f *fileSubStore) Load() (state, error) {
+	contents, err := os.ReadFile(filepath.Join(f.dir, stateFileName))
+	if os.IsNotExist(err) {
+		return state{}, nil
+	} else if err != nil {
+		return state{}, err
+	}
+
+	var j stateJSON
+	if err := json.Unmarshal(contents, &j); err != nil {
+		return state{}, err
+	}
+
+	return j.toState(), nil
+}
+
+func (f *fileSubStore) Snapshot(s state, dirty action) error {
+	if err := os.MkdirAll(f.dir, 0o755); err != nil {
+		return err
+	}
+
+	for name, cf := range stateCounterFiles {
+		if !cf.dirty(dirty) {
+			continue
+		}
+		value := *cf.field(&s)
+		if err := atomicWriteFile(filepath.Join(f.dir, name), []byte(strconv.Itoa(value))); err != nil {
+			return err
+		}
+	}
+
+	contents, err := json.Marshal(s.toJSON())
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(filepath.Join(f.dir, stateFileName), contents)
+}
+
+// AppendEvent is a no-op: the flat-file store only ever tracked the running
+// counters, not individual sub events.
+func (f *fileSubStore) AppendEvent(evt SubEvent) error {
+	return nil
+}
+
+// atomicWriteFile writes contents to path via a tempfile + rename, so a
+// concurrent reader never observes a half-written file.
+func atomicWriteFile(path string, contents []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, contents, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sqliteSubStore records every sub event alongside the running state, so
+// operators can audit or regenerate history later.
+type sqliteSubStore struct {
+	db *sql.DB
+}
+
+func newSQLiteSubStore(dsn string) (*sqliteSubStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS sub_events (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		ts       DATETIME NOT NULL,
+		user     TEXT NOT NULL,
+		msg_id   TEXT NOT NULL,
+		sub_plan TEXT NOT NULL,
+		months   INTEGER NOT NULL,
+		counted  BOOLEAN NOT NULL,
+		reason   TEXT NOT NULL DEFAULT ''
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migrateLegacySubEventsTable(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS state (
+		id                  INTEGER PRIMARY KEY CHECK (id = 1),
+		t1                  INTEGER NOT NULL,
+		t2                  INTEGER NOT NULL,
+		t3                  INTEGER NOT NULL,
+		gift_t1             INTEGER NOT NULL,
+		gift_t2             INTEGER NOT NULL,
+		gift_t3             INTEGER NOT NULL,
+		prime_conversions   INTEGER NOT NULL,
+		current_month_total INTEGER NOT NULL
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migrateLegacySubsColumn(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteSubStore{db: db}, nil
+}
+
+// migrateLegacySubsColumn upgrades a state table created by the original
+// single-counter schema (id, subs) to the per-tier/per-streak columns added
+// since. CREATE TABLE IF NOT EXISTS above leaves an existing table alone, so
+// without this, any deployment with a sqlite file from before per-tier
+// tracking would hit "no such column" on every Load/Snapshot after
+// upgrading. The legacy total is carried over into t1, since that was the
+// only counter that existed at the time.
+func migrateLegacySubsColumn(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(state)`)
+	if err != nil {
+		return err
+	}
+
+	var hasLegacySubs, hasT1 bool
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		switch name {
+		case "subs":
+			hasLegacySubs = true
+		case "t1":
+			hasT1 = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	if !hasLegacySubs || hasT1 {
+		return nil
+	}
+
+	for _, column := range []string{"t1", "t2", "t3", "gift_t1", "gift_t2", "gift_t3", "prime_conversions", "current_month_total"} {
+		if _, err := db.Exec(`ALTER TABLE state ADD COLUMN ` + column + ` INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`UPDATE state SET t1 = subs WHERE id = 1`); err != nil {
+		return err
+	}
+
+	// subs is NOT NULL with no default, so leaving it in place would make
+	// every Snapshot insert fail its NOT NULL constraint.
+	_, err = db.Exec(`ALTER TABLE state DROP COLUMN subs`)
+	return err
+}
+
+// migrateLegacySubEventsTable adds the reason column to a sub_events table
+// created before it existed. CREATE TABLE IF NOT EXISTS above leaves an
+// existing table alone, so without this, any deployment with a sqlite file
+// from before reason tracking would hit "no such column" on every
+// AppendEvent after upgrading.
+func migrateLegacySubEventsTable(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(sub_events)`)
+	if err != nil {
+		return err
+	}
+
+	var hasReason bool
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == "reason" {
+			hasReason = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	if hasReason {
+		return nil
+	}
+
+	_, err = db.Exec(`ALTER TABLE sub_events ADD COLUMN reason TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+func (s *sqliteSubStore) Load() (state, error) {
+	var st state
+	err := s.db.QueryRow(`
+		SELECT t1, t2, t3, gift_t1, gift_t2, gift_t3, prime_conversions, current_month_total
+		FROM state WHERE id = 1
+	`).Scan(&st.t1, &st.t2, &st.t3, &st.giftT1, &st.giftT2, &st.giftT3, &st.primeConversions, &st.currentMonthTotal)
+	if err == sql.ErrNoRows {
+		return state{}, nil
 	} else if err != nil {
-		logger.WithError(err).WithField("output-file", cfg.OutputFile).Warn("failed to read file, ignoring, starting at 0")
+		return state{}, err
+	}
+	return st, nil
+}
+
+// Snapshot always writes the full row in a single statement, so unlike
+// fileSubStore it has no use for dirty: there's no per-counter file to skip.
+func (s *sqliteSubStore) Snapshot(st state, dirty action) error {
+	_, err := s.db.Exec(`
+		INSERT INTO state (id, t1, t2, t3, gift_t1, gift_t2, gift_t3, prime_conversions, current_month_total)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			t1 = excluded.t1, t2 = excluded.t2, t3 = excluded.t3,
+			gift_t1 = excluded.gift_t1, gift_t2 = excluded.gift_t2, gift_t3 = excluded.gift_t3,
+			prime_conversions = excluded.prime_conversions,
+			current_month_total = excluded.current_month_total
+	`, st.t1, st.t2, st.t3, st.giftT1, st.giftT2, st.giftT3, st.primeConversions, st.currentMonthTotal)
+	return err
+}
+
+func (s *sqliteSubStore) AppendEvent(evt SubEvent) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sub_events (ts, user, msg_id, sub_plan, months, counted, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, evt.Time, evt.User, evt.MsgID, evt.SubPlan, evt.Months, evt.Counted, evt.Reason)
+	return err
+}
+
+// overlayEvent is pushed to /events subscribers every time the subcount
+// changes, so an OBS browser source can animate without polling.
+type overlayEvent struct {
+	Subs int       `json:"subs"`
+	Time time.Time `json:"time"`
+}
+
+// eventBroadcaster fans out overlayEvents to any number of SSE subscribers.
+type eventBroadcaster struct {
+	mu   sync.Mutex
+	subs []chan overlayEvent
+}
+
+func (b *eventBroadcaster) Subscribe() chan overlayEvent {
+	ch := make(chan overlayEvent, 4)
+	b.mu.Lock()
+	b.subs = append(b.subs, ch)
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroadcaster) Unsubscribe(ch chan overlayEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, sub := range b.subs {
+		if sub == ch {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+func (b *eventBroadcaster) Publish(evt overlayEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- evt:
+		default:
+			// subscriber isn't keeping up, drop the event rather than block
+		}
+	}
+}
+
+// startHTTPServer exposes GET/POST /subcount and GET /events (SSE) for OBS
+// overlays, so a streamer doesn't have to poll a text file. It's a no-op if
+// listen is empty.
+func startHTTPServer(listen string) {
+	if listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subcount", handleSubcount)
+	mux.HandleFunc("/events", handleEvents)
+
+	go func() {
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			logger.WithError(err).Fatal("HTTP API server failed")
+		}
+	}()
+
+	logger.WithField("address", listen).Info("HTTP API listening")
+}
+
+func handleSubcount(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleGetSubcount(w, r)
+	case http.MethodPost:
+		handlePostSubcount(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handleGetSubcount(w http.ResponseWriter, r *http.Request) {
+	lifeMu.Lock()
+	subs := life.Total()
+	lifeMu.Unlock()
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"subs": subs})
 		return
 	}
 
-	subs, err := strconv.Atoi(string(contents))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d", subs)
+}
+
+// handlePostSubcount is the HTTP equivalent of !nonprimesubcount, gated by
+// HTTPAuthToken since there's no chat badge to check here.
+func handlePostSubcount(w http.ResponseWriter, r *http.Request) {
+	if cfg.HTTPAuthToken == "" || r.Header.Get("Authorization") != "Bearer "+cfg.HTTPAuthToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		logger.WithError(err).WithField("contents", contents).Warn("failed to parse previous subcount, ignoring, starting at 0")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	life.MergeOutcome(outcome{
-		overwriteSubs: true,
-		subs:          subs,
-	})
-	logger.WithField("subcount", subs).Info("loaded previous subcount")
+	amt, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	lifeMu.Lock()
+	action := life.MergeOutcome(outcome{overwriteTier: 1, overwriteValue: amt})
+	performAction(action)
+	lifeMu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	sub := overlayEvents.Subscribe()
+	defer overlayEvents.Unsubscribe(sub)
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt := <-sub:
+			payload, err := json.Marshal(evt)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
 }
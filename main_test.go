@@ -1,89 +1,275 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"gopkg.in/irc.v3"
 )
 
+// TestMain initializes the global logger, since handlePostSubcount and
+// friends log through it even outside of main()'s normal startup path.
+func TestMain(m *testing.M) {
+	logger = logrus.New()
+	logger.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
 func Test_messageOutcome(t *testing.T) {
 	tests := []struct {
 		name string
+		cfg  Config
 		m    string
 		want outcome
 	}{
 		{
 			"nothing",
+			Config{},
 			"@color=#FF69B4;mod=0;user-type;badges;first-msg=0;returning-chatter=0;turbo=0;badge-info;flags :snip!snip@snip.tmi.twitch.tv PRIVMSG #eznoprimes :sample message",
 			outcome{},
 		},
 		{
 			"non-mod !nonprimesubcount - doesn't work",
+			Config{},
 			"@color=#FF69B4;mod=0;user-type;badges;first-msg=0;returning-chatter=0;turbo=0;badge-info;flags :snip!snip@snip.tmi.twitch.tv PRIVMSG #eznoprimes :!nonprimesubcount 3000",
 			outcome{},
 		},
 
 		{
 			"mod !nonprimesubcount",
+			Config{},
 			"@emotes;first-msg=0;badge-info=subscriber/5;badges=moderator/1,subscriber/3,hype-train/1;flags;subscriber=1;mod=1;turbo=0;color=#001122;returning-chatter=0;user-type=mod :snip!snip@snip.tmi.twitch.tv PRIVMSG #eznoprimes :!nonprimesubcount 123",
 			outcome{
-				overwriteSubs: true,
-				subs:          123,
+				overwriteTier:  1,
+				overwriteValue: 123,
 			},
 		},
 		{
 			"broadcaster !nonprimesubcount",
+			Config{},
 			"@badges=broadcaster/1,subscriber/3018,partner/1;returning-chatter=0;subscriber=1;turbo=0;badge-info=subscriber/18;color=#FFC2E5;flags;mod=0;user-type;emotes;first-msg=0;tmi-sent-ts=1682991722107 :eznoprimes!eznoprimes@eznoprimes.tmi.twitch.tv PRIVMSG #eznoprimes :!nonprimesubcount 123",
 			outcome{
-				overwriteSubs: true,
-				subs:          123,
+				overwriteTier:  1,
+				overwriteValue: 123,
+			},
+		},
+		{
+			"mod !nonprimet2count",
+			Config{},
+			"@emotes;first-msg=0;badge-info=subscriber/5;badges=moderator/1,subscriber/3,hype-train/1;flags;subscriber=1;mod=1;turbo=0;color=#001122;returning-chatter=0;user-type=mod :snip!snip@snip.tmi.twitch.tv PRIVMSG #eznoprimes :!nonprimet2count 7",
+			outcome{
+				overwriteTier:  2,
+				overwriteValue: 7,
 			},
 		},
+		{
+			"mod !nonprimet3count",
+			Config{},
+			"@emotes;first-msg=0;badge-info=subscriber/5;badges=moderator/1,subscriber/3,hype-train/1;flags;subscriber=1;mod=1;turbo=0;color=#001122;returning-chatter=0;user-type=mod :snip!snip@snip.tmi.twitch.tv PRIVMSG #eznoprimes :!nonprimet3count 2",
+			outcome{
+				overwriteTier:  3,
+				overwriteValue: 2,
+			},
+		},
+		{
+			"mod !nonprimereset",
+			Config{},
+			"@emotes;first-msg=0;badge-info=subscriber/5;badges=moderator/1,subscriber/3,hype-train/1;flags;subscriber=1;mod=1;turbo=0;color=#001122;returning-chatter=0;user-type=mod :snip!snip@snip.tmi.twitch.tv PRIVMSG #eznoprimes :!nonprimereset",
+			outcome{
+				resetAll: true,
+			},
+		},
+		{
+			"non-mod !nonprimereset - doesn't work",
+			Config{},
+			"@color=#FF69B4;mod=0;user-type;badges;first-msg=0;returning-chatter=0;turbo=0;badge-info;flags :snip!snip@snip.tmi.twitch.tv PRIVMSG #eznoprimes :!nonprimereset",
+			outcome{},
+		},
 
 		{
-			"gifted sub - doesn't count for partner plus",
+			"gifted sub - doesn't count by default",
+			Config{},
+			"@msg-param-months=5;msg-param-recipient-user-name=snip;mod=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);system-msg=snip\\sgifted\\sa\\sTier\\s1\\ssub\\sto\\ssnip!;color=#001122;flags;msg-param-sub-plan=1000;emotes;msg-id=subgift;login=snip;msg-param-gift-months=1;msg-param-recipient-msg-param-sender-count=0;badge-info;badges=premium/1;user-type;subscriber=0; :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				reason: "subgift",
+			},
+		},
+		{
+			"gifted sub - counts when CountGiftSubs is enabled",
+			Config{CountGiftSubs: true},
 			"@msg-param-months=5;msg-param-recipient-user-name=snip;mod=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);system-msg=snip\\sgifted\\sa\\sTier\\s1\\ssub\\sto\\ssnip!;color=#001122;flags;msg-param-sub-plan=1000;emotes;msg-id=subgift;login=snip;msg-param-gift-months=1;msg-param-recipient-msg-param-sender-count=0;badge-info;badges=premium/1;user-type;subscriber=0; :tmi.twitch.tv USERNOTICE #eznoprimes",
 			outcome{
-				incrementSubs: false,
-				subs:          0,
+				delta:  state{giftT1: 1, currentMonthTotal: 1},
+				reason: "subgift",
+			},
+		},
+		{
+			"gifted T2 sub - counts the right tier when CountGiftSubs is enabled",
+			Config{CountGiftSubs: true},
+			"@msg-param-months=5;msg-param-recipient-user-name=snip;mod=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);system-msg=snip\\sgifted\\sa\\sTier\\s2\\ssub\\sto\\ssnip!;color=#001122;flags;msg-param-sub-plan=2000;emotes;msg-id=subgift;login=snip;msg-param-gift-months=1;msg-param-recipient-msg-param-sender-count=0;badge-info;badges=premium/1;user-type;subscriber=0; :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				delta:  state{giftT2: 1, currentMonthTotal: 1},
+				reason: "subgift",
 			},
 		},
+		{
+			"mystery gift sub - doesn't count by default",
+			Config{},
+			"@badge-info=;badges=subscriber/1;color=;emotes=;flags=;login=snip;mod=0;msg-id=submysterygift;msg-param-mass-gift-count=5;msg-param-origin-id=abc;msg-param-sender-count=5;msg-param-sub-plan=1000;room-id=1;subscriber=1;system-msg=snip\\sis\\sgifting\\s5\\sTier\\s1\\sSubs\\sto\\seznoprimes's\\scommunity!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				reason: "submysterygift",
+			},
+		},
+		{
+			"mystery gift sub - still observability-only when CountGiftSubs is enabled, since the individual subgift notices are what count",
+			Config{CountGiftSubs: true},
+			"@badge-info=;badges=subscriber/1;color=;emotes=;flags=;login=snip;mod=0;msg-id=submysterygift;msg-param-mass-gift-count=5;msg-param-origin-id=abc;msg-param-sender-count=5;msg-param-sub-plan=1000;room-id=1;subscriber=1;system-msg=snip\\sis\\sgifting\\s5\\sTier\\s1\\sSubs\\sto\\seznoprimes's\\scommunity!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				reason: "submysterygift",
+			},
+		},
+		{
+			"anonymous gift sub - doesn't count by default",
+			Config{},
+			"@badge-info=;badges=;color=;emotes=;flags=;login=ananonymousgifter;mod=0;msg-id=anonsubgift;msg-param-months=1;msg-param-recipient-user-name=snip;msg-param-sub-plan=1000;room-id=1;subscriber=0;system-msg=An\\sanonymous\\suser\\sgifted\\sa\\sTier\\s1\\ssub\\sto\\ssnip!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				reason: "anonsubgift",
+			},
+		},
+
 		{
 			"prime resub - doesn't count for partner plus",
+			Config{},
 			"@login=snip;user-type;badge-info=subscriber/2;flags;msg-param-cumulative-months=2;msg-param-multimonth-duration=0;msg-param-was-gifted=false;emotes;mod=0;msg-id=resub;msg-param-multimonth-tenure=0;msg-param-should-share-streak=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);msg-param-sub-plan=Prime;badges=subscriber/2,premium/1;system-msg=snip\\ssubscribed\\swith\\sPrime.\\sThey've\\ssubscribed\\sfor\\s2\\smonths!;subscriber=1;msg-param-months=0;color=#001122 :tmi.twitch.tv USERNOTICE #eznoprimes :sample sub text",
 			outcome{
-				incrementSubs: false,
-				subs:          0,
+				reason: "resub:prime",
 			},
 		},
 		{
 			"T1 resub",
+			Config{},
 			"@login=snip;user-type;badge-info=subscriber/2;flags;msg-param-cumulative-months=2;msg-param-multimonth-duration=0;msg-param-was-gifted=false;emotes;mod=0;msg-id=resub;msg-param-multimonth-tenure=0;msg-param-should-share-streak=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);msg-param-sub-plan=1000;badges=subscriber/2,premium/1;system-msg=snip\\ssubscribed\\swith\\sPrime.\\sThey've\\ssubscribed\\sfor\\s2\\smonths!;subscriber=1;msg-param-months=0;color=#001122 :tmi.twitch.tv USERNOTICE #eznoprimes :sample sub text",
 			outcome{
-				incrementSubs: true,
-				subs:          1,
+				delta:  state{t1: 1, currentMonthTotal: 1},
+				reason: "resub",
+			},
+		},
+		{
+			"T1 multi-month resub counts months when CountResubMonths is enabled",
+			Config{CountResubMonths: true},
+			"@login=snip;user-type;badge-info=subscriber/2;flags;msg-param-cumulative-months=2;msg-param-multimonth-duration=6;msg-param-was-gifted=false;emotes;mod=0;msg-id=resub;msg-param-multimonth-tenure=0;msg-param-should-share-streak=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);msg-param-sub-plan=1000;badges=subscriber/2,premium/1;system-msg=snip\\ssubscribed\\swith\\sPrime.\\sThey've\\ssubscribed\\sfor\\s2\\smonths!;subscriber=1;msg-param-months=0;color=#001122 :tmi.twitch.tv USERNOTICE #eznoprimes :sample sub text",
+			outcome{
+				delta:  state{t1: 6, currentMonthTotal: 6},
+				reason: "resub",
+			},
+		},
+		{
+			"T2 resub",
+			Config{},
+			"@login=snip;user-type;badge-info=subscriber/2;flags;msg-param-cumulative-months=2;msg-param-multimonth-duration=0;msg-param-was-gifted=false;emotes;mod=0;msg-id=resub;msg-param-multimonth-tenure=0;msg-param-should-share-streak=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);msg-param-sub-plan=2000;badges=subscriber/2,premium/1;system-msg=snip\\ssubscribed\\swith\\sPrime.\\sThey've\\ssubscribed\\sfor\\s2\\smonths!;subscriber=1;msg-param-months=0;color=#001122 :tmi.twitch.tv USERNOTICE #eznoprimes :sample sub text",
+			outcome{
+				delta:  state{t2: 1, currentMonthTotal: 1},
+				reason: "resub",
+			},
+		},
+		{
+			"T3 sub",
+			Config{},
+			"@login=snip;user-type;badge-info=subscriber/2;flags;msg-param-cumulative-months=2;msg-param-multimonth-duration=0;msg-param-was-gifted=false;emotes;mod=0;msg-id=sub;msg-param-multimonth-tenure=0;msg-param-should-share-streak=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);msg-param-sub-plan=3000;badges=subscriber/2,premium/1;system-msg=snip\\ssubscribed\\swith\\sPrime.\\sThey've\\ssubscribed\\sfor\\s2\\smonths!;subscriber=1;msg-param-months=0;color=#001122 :tmi.twitch.tv USERNOTICE #eznoprimes :sample sub text",
+			outcome{
+				delta:  state{t3: 1, currentMonthTotal: 1},
+				reason: "sub",
 			},
 		},
 		{
 			"prime sub - doesn't count for partner plus",
+			Config{},
 			"@login=snip;user-type;badge-info=subscriber/2;flags;msg-param-cumulative-months=2;msg-param-multimonth-duration=0;msg-param-was-gifted=false;emotes;mod=0;msg-id=sub;msg-param-multimonth-tenure=0;msg-param-should-share-streak=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);msg-param-sub-plan=Prime;badges=subscriber/2,premium/1;system-msg=snip\\ssubscribed\\swith\\sPrime.\\sThey've\\ssubscribed\\sfor\\s2\\smonths!;subscriber=1;msg-param-months=0;color=#001122 :tmi.twitch.tv USERNOTICE #eznoprimes :sample sub text",
 			outcome{
-				incrementSubs: false,
-				subs:          0,
+				reason: "sub:prime",
 			},
 		},
 		{
 			"T1 sub",
+			Config{},
 			"@login=snip;user-type;badge-info=subscriber/2;flags;msg-param-cumulative-months=2;msg-param-multimonth-duration=0;msg-param-was-gifted=false;emotes;mod=0;msg-id=sub;msg-param-multimonth-tenure=0;msg-param-should-share-streak=0;msg-param-sub-plan-name=Channel\\sSubscription\\s(eznoprimes);msg-param-sub-plan=1000;badges=subscriber/2,premium/1;system-msg=snip\\ssubscribed\\swith\\sPrime.\\sThey've\\ssubscribed\\sfor\\s2\\smonths!;subscriber=1;msg-param-months=0;color=#001122 :tmi.twitch.tv USERNOTICE #eznoprimes :sample sub text",
 			outcome{
-				incrementSubs: true,
-				subs:          1,
+				delta:  state{t1: 1, currentMonthTotal: 1},
+				reason: "sub",
+			},
+		},
+
+		{
+			"prime upgrade always counts as a new non-prime sub and a prime conversion",
+			Config{},
+			"@badge-info=;badges=subscriber/0;color=;emotes=;flags=;login=snip;mod=0;msg-id=primepaidupgrade;msg-param-sub-plan=1000;room-id=1;subscriber=1;system-msg=snip\\sconverted\\sfrom\\sa\\sTwitch\\sPrime\\ssub\\sto\\sa\\sTier\\s1\\ssub!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				delta:  state{t1: 1, primeConversions: 1, currentMonthTotal: 1},
+				reason: "primepaidupgrade",
+			},
+		},
+		{
+			"gift upgrade - doesn't count by default",
+			Config{},
+			"@badge-info=subscriber/1;badges=subscriber/0;color=;emotes=;flags=;login=snip;mod=0;msg-id=giftpaidupgrade;msg-param-sender-login=gifter;msg-param-sender-name=Gifter;room-id=1;subscriber=1;system-msg=snip\\sis\\scontinuing\\sthe\\sGift\\sSub\\sthey\\sgot\\sfrom\\sGifter!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				reason: "giftpaidupgrade",
+			},
+		},
+		{
+			"gift upgrade - counts as a regular tier sub when CountGiftUpgrades is enabled",
+			Config{CountGiftUpgrades: true},
+			"@badge-info=subscriber/1;badges=subscriber/0;color=;emotes=;flags=;login=snip;mod=0;msg-id=giftpaidupgrade;msg-param-sender-login=gifter;msg-param-sender-name=Gifter;room-id=1;subscriber=1;system-msg=snip\\sis\\scontinuing\\sthe\\sGift\\sSub\\sthey\\sgot\\sfrom\\sGifter!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				delta:  state{t1: 1, currentMonthTotal: 1},
+				reason: "giftpaidupgrade",
+			},
+		},
+		{
+			"anonymous gift upgrade - doesn't count by default",
+			Config{},
+			"@badge-info=subscriber/1;badges=subscriber/0;color=;emotes=;flags=;login=snip;mod=0;msg-id=anongiftpaidupgrade;room-id=1;subscriber=1;system-msg=snip\\sis\\scontinuing\\sthe\\sGift\\sSub\\sthey\\sgot\\sfrom\\san\\sanonymous\\sgifter!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				reason: "anongiftpaidupgrade",
+			},
+		},
+
+		{
+			"standard pay it forward is observability-only",
+			Config{},
+			"@badge-info=;badges=subscriber/1;color=;emotes=;flags=;login=snip;mod=0;msg-id=standardpayforward;msg-param-prior-gifter-anonymous=false;msg-param-prior-gifter-display-name=PriorGifter;msg-param-prior-gifter-id=2;msg-param-prior-gifter-user-name=priorgifter;msg-param-recipient-display-name=Recipient;msg-param-recipient-id=3;msg-param-recipient-user-name=recipient;room-id=1;subscriber=1;system-msg=snip\\sis\\spaying\\sforward\\sthe\\sGift\\sthey\\sgot\\sfrom\\sPriorGifter\\sto\\sRecipient!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				reason: "standardpayforward",
+			},
+		},
+		{
+			"community pay it forward is observability-only",
+			Config{},
+			"@badge-info=;badges=subscriber/1;color=;emotes=;flags=;login=snip;mod=0;msg-id=communitypayforward;msg-param-prior-gifter-anonymous=false;msg-param-prior-gifter-display-name=PriorGifter;msg-param-prior-gifter-id=2;msg-param-prior-gifter-user-name=priorgifter;room-id=1;subscriber=1;system-msg=snip\\sis\\spaying\\sforward\\sthe\\sGift\\sthey\\sgot\\sto\\sthe\\scommunity!;user-type= :tmi.twitch.tv USERNOTICE #eznoprimes",
+			outcome{
+				reason: "communitypayforward",
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			cfg = tt.cfg
 			if got := messageOutcome(irc.MustParseMessage(tt.m)); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("messageOutcome() = %+v, want %+v", got, tt.want)
 			}
@@ -101,59 +287,744 @@ func Test_state_MergeOutcome(t *testing.T) {
 	}{
 		{
 			"do nothing",
-			state{
-				subs: 1234,
-			},
+			state{t1: 1234},
 			outcome{},
 			action{},
-			state{
-				subs: 1234,
-			},
+			state{t1: 1234},
 		},
 
 		{
-			"increment subs",
-			state{
-				subs: 1234,
-			},
-			outcome{
-				incrementSubs: true,
-				subs:          1,
-			},
-			action{
-				writeSubs: true,
-			},
-			state{
-				subs: 1235,
-			},
+			"increment T1",
+			state{t1: 1234},
+			outcome{delta: state{t1: 1, currentMonthTotal: 1}},
+			action{DirtyT1: true, DirtyCurrentMonthTotal: true},
+			state{t1: 1235, currentMonthTotal: 1},
 		},
 
 		{
-			"overwrite subs",
-			state{
-				subs: 1234,
-			},
-			outcome{
-				overwriteSubs: true,
-				subs:          69,
-			},
+			"increment T2 gift",
+			state{giftT2: 4},
+			outcome{delta: state{giftT2: 1, currentMonthTotal: 1}},
+			action{DirtyGiftT2: true, DirtyCurrentMonthTotal: true},
+			state{giftT2: 5, currentMonthTotal: 1},
+		},
+
+		{
+			"prime conversion increments both its tier and the conversion counter",
+			state{t1: 1, primeConversions: 2},
+			outcome{delta: state{t1: 1, primeConversions: 1, currentMonthTotal: 1}},
+			action{DirtyT1: true, DirtyPrimeConversions: true, DirtyCurrentMonthTotal: true},
+			state{t1: 2, primeConversions: 3, currentMonthTotal: 1},
+		},
+
+		{
+			"overwrite T1",
+			state{t1: 1234, t2: 5},
+			outcome{overwriteTier: 1, overwriteValue: 69},
+			action{DirtyT1: true},
+			state{t1: 69, t2: 5},
+		},
+
+		{
+			"overwrite T2",
+			state{t1: 1234, t2: 5},
+			outcome{overwriteTier: 2, overwriteValue: 9},
+			action{DirtyT2: true},
+			state{t1: 1234, t2: 9},
+		},
+
+		{
+			"overwrite T3",
+			state{t3: 5},
+			outcome{overwriteTier: 3, overwriteValue: 12},
+			action{DirtyT3: true},
+			state{t3: 12},
+		},
+
+		{
+			"reset zeroes everything",
+			state{t1: 1, t2: 2, t3: 3, giftT1: 4, giftT2: 5, giftT3: 6, primeConversions: 7, currentMonthTotal: 8},
+			outcome{resetAll: true},
 			action{
-				writeSubs: true,
-			},
-			state{
-				subs: 69,
+				DirtyT1: true, DirtyT2: true, DirtyT3: true,
+				DirtyGiftT1: true, DirtyGiftT2: true, DirtyGiftT3: true,
+				DirtyPrimeConversions: true, DirtyCurrentMonthTotal: true,
 			},
+			state{},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			state := tt.initial
 			if got := state.MergeOutcome(tt.applied); !reflect.DeepEqual(got, tt.expected) {
-				t.Errorf("state.MergeOutcome() actions = %v, want %v", got, tt.expected)
+				t.Errorf("state.MergeOutcome() actions = %+v, want %+v", got, tt.expected)
 			}
 			if !reflect.DeepEqual(state, tt.final) {
-				t.Errorf("state.MergeOutcome() final = %v, want %v", state, tt.final)
+				t.Errorf("state.MergeOutcome() final = %+v, want %+v", state, tt.final)
+			}
+		})
+	}
+}
+
+func Test_state_Total(t *testing.T) {
+	s := state{
+		t1: 1, t2: 2, t3: 3,
+		giftT1: 4, giftT2: 5, giftT3: 6,
+		primeConversions:  100,
+		currentMonthTotal: 200,
+	}
+	if got, want := s.Total(), 21; got != want {
+		t.Errorf("state.Total() = %d, want %d", got, want)
+	}
+}
+
+func Test_diffTranscript(t *testing.T) {
+	tests := []struct {
+		name string
+		want []transcriptEntry
+		got  []transcriptEntry
+		diff bool
+	}{
+		{
+			"identical",
+			[]transcriptEntry{{Line: "a", Subs: 1}},
+			[]transcriptEntry{{Line: "a", Subs: 1}},
+			false,
+		},
+		{
+			"different subs",
+			[]transcriptEntry{{Line: "a", Subs: 1}},
+			[]transcriptEntry{{Line: "a", Subs: 2}},
+			true,
+		},
+		{
+			"different length",
+			[]transcriptEntry{{Line: "a", Subs: 1}},
+			[]transcriptEntry{{Line: "a", Subs: 1}, {Line: "b", Subs: 2}},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffTranscript(tt.want, tt.got) != ""; got != tt.diff {
+				t.Errorf("diffTranscript() non-empty = %v, want %v", got, tt.diff)
+			}
+		})
+	}
+}
+
+// Test_transcriptEntry_jsonRoundTrip exercises the same marshal/unmarshal
+// path runReplay uses to write and re-read a golden file. action's fields
+// used to be unexported, so every Action round-tripped to the zero value and
+// diffTranscript spuriously flagged every meaningful line as a mismatch.
+func Test_transcriptEntry_jsonRoundTrip(t *testing.T) {
+	want := transcriptEntry{
+		Line: "sample",
+		Action: action{
+			DirtyT1:                true,
+			DirtyCurrentMonthTotal: true,
+		},
+		Subs: 1,
+	}
+
+	marshaled, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+
+	var got transcriptEntry
+	if err := json.Unmarshal(marshaled, &got); err != nil {
+		t.Fatalf("json.Unmarshal() = %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round-tripped transcriptEntry = %+v, want %+v", got, want)
+	}
+	if got.Action == (action{}) {
+		t.Errorf("round-tripped Action is the zero value, want %+v", want.Action)
+	}
+}
+
+func Test_fileSubStore(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileSubStore(dir)
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() on empty dir = %v", err)
+	}
+	if got != (state{}) {
+		t.Errorf("Load() on empty dir = %+v, want zero value", got)
+	}
+
+	want := state{t1: 1, t2: 2, t3: 3, giftT1: 4, giftT2: 5, giftT3: 6, primeConversions: 7, currentMonthTotal: 8}
+	if err := store.Snapshot(want, allDirty); err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+
+	got, err = store.Load()
+	if err != nil {
+		t.Fatalf("Load() after Snapshot() = %v", err)
+	}
+	if got != want {
+		t.Errorf("Load() after Snapshot() = %+v, want %+v", got, want)
+	}
+
+	for name, cf := range stateCounterFiles {
+		contents, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		if want := strconv.Itoa(*cf.field(&want)); string(contents) != want {
+			t.Errorf("%s = %q, want %q", name, contents, want)
+		}
+	}
+
+	// AppendEvent is a no-op for this backend: it only tracks running counters.
+	if err := store.AppendEvent(SubEvent{User: "snip"}); err != nil {
+		t.Errorf("AppendEvent() = %v, want nil", err)
+	}
+}
+
+// allDirty marks every counter dirty, for tests that want a full write.
+var allDirty = action{
+	DirtyT1: true, DirtyT2: true, DirtyT3: true,
+	DirtyGiftT1: true, DirtyGiftT2: true, DirtyGiftT3: true,
+	DirtyPrimeConversions: true, DirtyCurrentMonthTotal: true,
+}
+
+// Test_fileSubStore_scopesWritesToDirtyCounters asserts Snapshot only
+// rewrites the on-disk files for counters flagged dirty, leaving the others
+// (and their mtimes) untouched - the whole point of action's per-field flags.
+func Test_fileSubStore_scopesWritesToDirtyCounters(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileSubStore(dir)
+
+	initial := state{t1: 1, t2: 2, t3: 3, giftT1: 4, giftT2: 5, giftT3: 6, primeConversions: 7, currentMonthTotal: 8}
+	if err := store.Snapshot(initial, allDirty); err != nil {
+		t.Fatalf("initial Snapshot() = %v", err)
+	}
+
+	mtimesBefore := map[string]time.Time{}
+	for name := range stateCounterFiles {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		mtimesBefore[name] = info.ModTime()
+	}
+
+	time.Sleep(10 * time.Millisecond) // ensure a changed file's mtime would visibly differ
+
+	updated := initial
+	updated.t1 = 100
+	if err := store.Snapshot(updated, action{DirtyT1: true}); err != nil {
+		t.Fatalf("Snapshot() with only DirtyT1 = %v", err)
+	}
+
+	for name := range stateCounterFiles {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		changed := info.ModTime().After(mtimesBefore[name])
+		if name == "t1.txt" && !changed {
+			t.Errorf("%s was not rewritten, want it rewritten since DirtyT1 was set", name)
+		}
+		if name != "t1.txt" && changed {
+			t.Errorf("%s was rewritten, want it untouched since its dirty flag wasn't set", name)
+		}
+	}
+}
+
+func Test_sqliteSubStore(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "subs.db")
+	store, err := newSQLiteSubStore(dsn)
+	if err != nil {
+		t.Fatalf("newSQLiteSubStore() = %v", err)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() on fresh db = %v", err)
+	}
+	if got != (state{}) {
+		t.Errorf("Load() on fresh db = %+v, want zero value", got)
+	}
+
+	want := state{t1: 1, t2: 2, t3: 3, giftT1: 4, giftT2: 5, giftT3: 6, primeConversions: 7, currentMonthTotal: 8}
+	if err := store.Snapshot(want, allDirty); err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+
+	got, err = store.Load()
+	if err != nil {
+		t.Fatalf("Load() after Snapshot() = %v", err)
+	}
+	if got != want {
+		t.Errorf("Load() after Snapshot() = %+v, want %+v", got, want)
+	}
+
+	evt := SubEvent{Time: time.Now(), User: "snip", MsgID: "sub", SubPlan: "1000", Months: 1, Counted: true, Reason: "sub"}
+	if err := store.AppendEvent(evt); err != nil {
+		t.Fatalf("AppendEvent() = %v", err)
+	}
+
+	var count int
+	var reason string
+	if err := store.db.QueryRow(`SELECT COUNT(*), reason FROM sub_events GROUP BY reason`).Scan(&count, &reason); err != nil {
+		t.Fatalf("querying sub_events: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("sub_events count = %d, want 1", count)
+	}
+	if reason != "sub" {
+		t.Errorf("sub_events reason = %q, want %q", reason, "sub")
+	}
+}
+
+// Test_sqliteSubStore_migratesLegacySubEventsTable seeds a sqlite file with
+// the sub_events schema predating the reason column, then asserts
+// newSQLiteSubStore adds it so AppendEvent doesn't fail with "no such column".
+func Test_sqliteSubStore_migratesLegacySubEventsTable(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "legacy-events.db")
+
+	legacyDB, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open() = %v", err)
+	}
+	if _, err := legacyDB.Exec(`CREATE TABLE sub_events (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		ts       DATETIME NOT NULL,
+		user     TEXT NOT NULL,
+		msg_id   TEXT NOT NULL,
+		sub_plan TEXT NOT NULL,
+		months   INTEGER NOT NULL,
+		counted  BOOLEAN NOT NULL
+	)`); err != nil {
+		t.Fatalf("creating legacy table: %v", err)
+	}
+	if err := legacyDB.Close(); err != nil {
+		t.Fatalf("closing legacy db: %v", err)
+	}
+
+	store, err := newSQLiteSubStore(dsn)
+	if err != nil {
+		t.Fatalf("newSQLiteSubStore() on legacy schema = %v", err)
+	}
+
+	if err := store.AppendEvent(SubEvent{Time: time.Now(), User: "snip", MsgID: "sub", Reason: "sub"}); err != nil {
+		t.Fatalf("AppendEvent() after migration = %v", err)
+	}
+}
+
+// Test_sqliteSubStore_migratesLegacySchema seeds a sqlite file with the
+// original single-counter schema (id, subs) predating per-tier tracking,
+// then asserts newSQLiteSubStore migrates it in place and carries the old
+// total forward into t1.
+func Test_sqliteSubStore_migratesLegacySchema(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "legacy.db")
+
+	legacyDB, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open() = %v", err)
+	}
+	if _, err := legacyDB.Exec(`CREATE TABLE state (id INTEGER PRIMARY KEY CHECK (id = 1), subs INTEGER NOT NULL)`); err != nil {
+		t.Fatalf("creating legacy table: %v", err)
+	}
+	if _, err := legacyDB.Exec(`INSERT INTO state (id, subs) VALUES (1, 42)`); err != nil {
+		t.Fatalf("seeding legacy row: %v", err)
+	}
+	if err := legacyDB.Close(); err != nil {
+		t.Fatalf("closing legacy db: %v", err)
+	}
+
+	store, err := newSQLiteSubStore(dsn)
+	if err != nil {
+		t.Fatalf("newSQLiteSubStore() on legacy schema = %v", err)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() after migration = %v", err)
+	}
+	if want := (state{t1: 42}); got != want {
+		t.Errorf("Load() after migration = %+v, want %+v", got, want)
+	}
+}
+
+func Test_handleSubcount_get(t *testing.T) {
+	lifeMu.Lock()
+	life = state{t1: 3, t2: 2}
+	lifeMu.Unlock()
+
+	tests := []struct {
+		name            string
+		accept          string
+		wantBody        string
+		wantContentType string
+	}{
+		{"plain text by default", "", "5", "text/plain; charset=utf-8"},
+		{"json when Accept asks for it", "application/json", "{\"subs\":5}\n", "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/subcount", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			handleSubcount(rec, req)
+
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
 			}
 		})
 	}
 }
+
+func Test_handleSubcount_post(t *testing.T) {
+	origCfg, origStore := cfg, store
+	defer func() { cfg, store = origCfg, origStore }()
+
+	tests := []struct {
+		name       string
+		authToken  string
+		authHeader string
+		body       string
+		wantStatus int
+		wantT1     int
+	}{
+		{"no auth token configured, always unauthorized", "", "Bearer whatever", "42", http.StatusUnauthorized, 0},
+		{"wrong bearer token", "secret", "Bearer nope", "42", http.StatusUnauthorized, 0},
+		{"correct token overwrites T1", "secret", "Bearer secret", "42", http.StatusNoContent, 42},
+		{"correct token, non-numeric body is rejected", "secret", "Bearer secret", "not-a-number", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg = Config{HTTPAuthToken: tt.authToken}
+			store = newFileSubStore(t.TempDir())
+			lifeMu.Lock()
+			life = state{}
+			lifeMu.Unlock()
+
+			req := httptest.NewRequest(http.MethodPost, "/subcount", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", tt.authHeader)
+			rec := httptest.NewRecorder()
+
+			handleSubcount(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			lifeMu.Lock()
+			gotT1 := life.t1
+			lifeMu.Unlock()
+			if gotT1 != tt.wantT1 {
+				t.Errorf("life.t1 = %d, want %d", gotT1, tt.wantT1)
+			}
+		})
+	}
+}
+
+// syncRecorder wraps httptest.ResponseRecorder behind a mutex, since
+// handleEvents writes to it from a background goroutine while the test
+// concurrently reads the body it's accumulated so far.
+type syncRecorder struct {
+	mu  sync.Mutex
+	rec *httptest.ResponseRecorder
+}
+
+func newSyncRecorder() *syncRecorder {
+	return &syncRecorder{rec: httptest.NewRecorder()}
+}
+
+func (s *syncRecorder) Header() http.Header {
+	return s.rec.Header()
+}
+
+func (s *syncRecorder) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rec.Write(p)
+}
+
+func (s *syncRecorder) WriteHeader(statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rec.WriteHeader(statusCode)
+}
+
+func (s *syncRecorder) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rec.Flush()
+}
+
+func (s *syncRecorder) body() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rec.Body.String()
+}
+
+// waitUntil polls cond until it's true or the timeout elapses, failing the
+// test in the latter case. Used to synchronize with handleEvents' background
+// subscribe/publish without an artificial sleep.
+func waitUntil(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("condition not met before timeout")
+}
+
+func Test_handleEvents(t *testing.T) {
+	origEvents := overlayEvents
+	overlayEvents = &eventBroadcaster{}
+	defer func() { overlayEvents = origEvents }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/events", nil).WithContext(ctx)
+	rec := newSyncRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		handleEvents(rec, req)
+		close(done)
+	}()
+
+	waitUntil(t, time.Second, func() bool {
+		overlayEvents.mu.Lock()
+		defer overlayEvents.mu.Unlock()
+		return len(overlayEvents.subs) == 1
+	})
+
+	overlayEvents.Publish(overlayEvent{Subs: 42})
+
+	waitUntil(t, time.Second, func() bool {
+		return strings.Contains(rec.body(), `"subs":42`)
+	})
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleEvents did not return after context cancellation")
+	}
+
+	if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want %q", got, "text/event-stream")
+	}
+}
+
+// fakeRWC is an io.ReadWriteCloser standing in for a real IRC connection in
+// handshake tests: Read always blocks until closed (client.Run isn't
+// exercised here, only individual handlers), and Write can be told to fail
+// so abortHandshake's non-fatal path can be verified.
+type fakeRWC struct {
+	mu        sync.Mutex
+	written   []string
+	failWrite bool
+	closed    bool
+	readBlock chan struct{}
+}
+
+func newFakeRWC() *fakeRWC {
+	return &fakeRWC{readBlock: make(chan struct{})}
+}
+
+func (f *fakeRWC) Read(p []byte) (int, error) {
+	<-f.readBlock
+	return 0, io.EOF
+}
+
+func (f *fakeRWC) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failWrite {
+		return 0, fmt.Errorf("write failed")
+	}
+	f.written = append(f.written, string(p))
+	return len(p), nil
+}
+
+func (f *fakeRWC) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.readBlock)
+	}
+	return nil
+}
+
+func (f *fakeRWC) lines() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.written...)
+}
+
+func (f *fakeRWC) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// The remaining methods make fakeRWC satisfy net.Conn, since activeConn is
+// typed net.Conn; none of the handshake code under test calls them.
+func (f *fakeRWC) LocalAddr() net.Addr                { return nil }
+func (f *fakeRWC) RemoteAddr() net.Addr               { return nil }
+func (f *fakeRWC) SetDeadline(t time.Time) error      { return nil }
+func (f *fakeRWC) SetReadDeadline(t time.Time) error  { return nil }
+func (f *fakeRWC) SetWriteDeadline(t time.Time) error { return nil }
+
+// withHandshakeState sets up the package-level connection state the
+// handshake functions read/write and restores it afterwards, so tests don't
+// leak state into each other.
+func withHandshakeState(t *testing.T, conn net.Conn) {
+	t.Helper()
+	origCfg, origPending, origConn := cfg, pendingSaslPayload, activeConn
+	resetConnState(conn)
+	t.Cleanup(func() {
+		cfg, pendingSaslPayload, activeConn = origCfg, origPending, origConn
+	})
+}
+
+func Test_handleCap_startsSaslOnAck(t *testing.T) {
+	rwc := newFakeRWC()
+	defer rwc.Close()
+	client := irc.NewClient(rwc, irc.ClientConfig{})
+
+	withHandshakeState(t, nil)
+	cfg.SASL = true
+	cfg.IRCUser = "bot"
+	cfg.OAuthToken = "tok123"
+
+	handleCap(client, irc.MustParseMessage("CAP * ACK :sasl"))
+
+	want := base64.StdEncoding.EncodeToString([]byte("\x00bot\x00tok123"))
+	if pendingSaslPayload != want {
+		t.Errorf("pendingSaslPayload = %q, want %q", pendingSaslPayload, want)
+	}
+	if lines := rwc.lines(); len(lines) != 1 || lines[0] != "AUTHENTICATE PLAIN\r\n" {
+		t.Errorf("written lines = %q, want [%q]", lines, "AUTHENTICATE PLAIN\r\n")
+	}
+}
+
+func Test_handleCap_ignoresAckWithoutSasl(t *testing.T) {
+	rwc := newFakeRWC()
+	defer rwc.Close()
+	client := irc.NewClient(rwc, irc.ClientConfig{})
+
+	withHandshakeState(t, nil)
+	cfg.SASL = true
+
+	handleCap(client, irc.MustParseMessage("CAP * ACK :twitch.tv/tags"))
+
+	if pendingSaslPayload != "" {
+		t.Errorf("pendingSaslPayload = %q, want empty", pendingSaslPayload)
+	}
+	if lines := rwc.lines(); len(lines) != 0 {
+		t.Errorf("written lines = %q, want none", lines)
+	}
+}
+
+func Test_handleCap_abortsOnWriteFailure(t *testing.T) {
+	rwc := newFakeRWC()
+	rwc.failWrite = true
+	client := irc.NewClient(rwc, irc.ClientConfig{})
+
+	withHandshakeState(t, rwc)
+	cfg.SASL = true
+	cfg.IRCUser = "bot"
+	cfg.OAuthToken = "tok123"
+
+	handleCap(client, irc.MustParseMessage("CAP * ACK :sasl"))
+
+	if !rwc.isClosed() {
+		t.Error("activeConn was not closed after a failed handshake write")
+	}
+}
+
+func Test_handleAuthenticate_sendsPendingPayload(t *testing.T) {
+	rwc := newFakeRWC()
+	defer rwc.Close()
+	client := irc.NewClient(rwc, irc.ClientConfig{})
+
+	withHandshakeState(t, nil)
+	pendingSaslPayload = "cGF5bG9hZA=="
+
+	handleAuthenticate(client, irc.MustParseMessage("AUTHENTICATE +"))
+
+	if lines := rwc.lines(); len(lines) != 1 || lines[0] != "AUTHENTICATE cGF5bG9hZA==\r\n" {
+		t.Errorf("written lines = %q, want [%q]", lines, "AUTHENTICATE cGF5bG9hZA==\r\n")
+	}
+}
+
+func Test_handleAuthenticate_ignoresWithoutPendingPayload(t *testing.T) {
+	rwc := newFakeRWC()
+	defer rwc.Close()
+	client := irc.NewClient(rwc, irc.ClientConfig{})
+
+	withHandshakeState(t, nil)
+
+	handleAuthenticate(client, irc.MustParseMessage("AUTHENTICATE +"))
+
+	if lines := rwc.lines(); len(lines) != 0 {
+		t.Errorf("written lines = %q, want none", lines)
+	}
+}
+
+func Test_handleAuthenticate_abortsOnWriteFailure(t *testing.T) {
+	rwc := newFakeRWC()
+	rwc.failWrite = true
+	client := irc.NewClient(rwc, irc.ClientConfig{})
+
+	withHandshakeState(t, rwc)
+	pendingSaslPayload = "cGF5bG9hZA=="
+
+	handleAuthenticate(client, irc.MustParseMessage("AUTHENTICATE +"))
+
+	if !rwc.isClosed() {
+		t.Error("activeConn was not closed after a failed handshake write")
+	}
+}
+
+func Test_nextBackoff(t *testing.T) {
+	tests := []struct {
+		in, want time.Duration
+	}{
+		{time.Second, 2 * time.Second},
+		{time.Minute, 2 * time.Minute},
+		{maxReconnectBackoff, maxReconnectBackoff},
+		{maxReconnectBackoff/2 + time.Second, maxReconnectBackoff},
+	}
+	for _, tt := range tests {
+		if got := nextBackoff(tt.in); got != tt.want {
+			t.Errorf("nextBackoff(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func Test_jitter(t *testing.T) {
+	d := 10 * time.Second
+	for i := 0; i < 50; i++ {
+		got := jitter(d)
+		if got < 0 || got > d {
+			t.Fatalf("jitter(%v) = %v, want in [0, %v]", d, got, d)
+		}
+	}
+	if got := jitter(0); got != 0 {
+		t.Errorf("jitter(0) = %v, want 0", got)
+	}
+}